@@ -0,0 +1,119 @@
+package nds
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// AdmissionPolicy decides whether an entity read from the datastore by
+// GetMulti should be saved to memcache. Admit is called with the memcache key
+// of every entity GetMulti could not find in memcache and must be safe for
+// concurrent use.
+type AdmissionPolicy interface {
+	Admit(memcacheKey string) bool
+}
+
+var admissionPolicyKey = "used for AdmissionPolicy"
+
+// WithAdmissionPolicy returns a context that makes GetMulti and Get only save
+// entities to memcache that policy admits. Contexts without a policy save
+// every entity they read from the datastore.
+func WithAdmissionPolicy(c context.Context,
+	policy AdmissionPolicy) context.Context {
+	return context.WithValue(c, &admissionPolicyKey, policy)
+}
+
+func admissionPolicyFromContext(c context.Context) AdmissionPolicy {
+	policy, _ := c.Value(&admissionPolicyKey).(AdmissionPolicy)
+	return policy
+}
+
+// frequencySketchDepth is the number of hash functions, and so rows of
+// counters, used by FrequencyAdmission's count-min sketch.
+const frequencySketchDepth = 4
+
+// FrequencyAdmission is an AdmissionPolicy that only admits a key once it has
+// been read from the datastore a threshold number of times within a window.
+// This keeps keys that are only ever read once from displacing hot keys in
+// memcache.
+//
+// Read counts are approximated using a count-min sketch, which never
+// undercounts but may overcount when keys collide. The sketch uses
+// 4*4*width bytes of memory regardless of the number of keys seen. Counts are
+// kept per instance so on App Engine a key must be read threshold times by the
+// same instance before it is cached.
+type FrequencyAdmission struct {
+	threshold uint32
+	window    time.Duration
+
+	// now is replaced in tests to control the window.
+	now func() time.Time
+
+	mu      sync.Mutex
+	resetAt time.Time
+	counts  [frequencySketchDepth][]uint32
+}
+
+// NewFrequencyAdmission creates a FrequencyAdmission that admits a key on its
+// threshold read within window. width is the number of counters in each row
+// of the sketch and must be greater than zero; larger widths reduce
+// overcounting at the cost of memory. NewFrequencyAdmission panics if
+// threshold is negative or width is not positive.
+func NewFrequencyAdmission(threshold int, window time.Duration,
+	width int) *FrequencyAdmission {
+
+	if threshold < 0 {
+		panic("nds: NewFrequencyAdmission threshold is negative")
+	}
+	if width <= 0 {
+		panic("nds: NewFrequencyAdmission width is not positive")
+	}
+
+	fa := &FrequencyAdmission{
+		threshold: uint32(threshold),
+		window:    window,
+		now:       time.Now,
+		resetAt:   time.Now().Add(window),
+	}
+	for i := range fa.counts {
+		fa.counts[i] = make([]uint32, width)
+	}
+	return fa
+}
+
+// Admit records a read of memcacheKey and reports whether it has now been read
+// at least the threshold number of times in the current window.
+func (fa *FrequencyAdmission) Admit(memcacheKey string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(memcacheKey))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if now := fa.now(); !now.Before(fa.resetAt) {
+		for i := range fa.counts {
+			for j := range fa.counts[i] {
+				fa.counts[i][j] = 0
+			}
+		}
+		fa.resetAt = now.Add(fa.window)
+	}
+
+	min := ^uint32(0)
+	for i := range fa.counts {
+		row := fa.counts[i]
+		j := (h1 + uint32(i)*h2) % uint32(len(row))
+		if row[j] < ^uint32(0) {
+			row[j]++
+		}
+		if row[j] < min {
+			min = row[j]
+		}
+	}
+	return min >= fa.threshold
+}
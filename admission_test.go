@@ -0,0 +1,113 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestFrequencyAdmission(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+
+	policy := nds.NewFrequencyAdmission(2, time.Hour, 1024)
+	pc := nds.WithAdmissionPolicy(c, policy)
+
+	// The first read should not be saved to memcache.
+	if err := nds.Get(pc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache miss but got", err)
+	}
+
+	// The second read reaches the threshold.
+	entity := &testEntity{}
+	if err := nds.Get(pc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item but got flags", item.Flags)
+	}
+}
+
+func TestFrequencyAdmissionWindow(t *testing.T) {
+	policy := nds.NewFrequencyAdmission(2, time.Minute, 1024)
+
+	now := time.Now()
+	nds.SetFrequencyAdmissionNow(policy, func() time.Time {
+		return now
+	})
+
+	if policy.Admit("key") {
+		t.Fatal("expected first read to be rejected")
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if policy.Admit("key") {
+		t.Fatal("expected read after the window to be rejected")
+	}
+	if !policy.Admit("key") {
+		t.Fatal("expected second read in the window to be admitted")
+	}
+}
+
+func TestNewFrequencyAdmissionInvalid(t *testing.T) {
+	for _, args := range [][2]int{{-1, 1024}, {2, 0}, {2, -1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic for", args)
+				}
+			}()
+			nds.NewFrequencyAdmission(args[0], time.Minute, args[1])
+		}()
+	}
+}
+
+// A key repeated within one GetMulti is only one read.
+func TestFrequencyAdmissionDuplicateKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := nds.NewFrequencyAdmission(2, time.Hour, 1024)
+	pc := nds.WithAdmissionPolicy(c, policy)
+
+	vals := make([]testEntity, 2)
+	if err := nds.GetMulti(pc, []*datastore.Key{key, key}, vals); err != nil {
+		t.Fatal(err)
+	}
+	_, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache miss but got", err)
+	}
+}
@@ -0,0 +1,186 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// AuditState describes how the memcache copy of an entity compares to the
+// datastore copy.
+type AuditState int
+
+const (
+	// AuditUnknown means the key could not be audited because reading it from
+	// memcache or the datastore failed. It is the zero value so a result is
+	// never mistaken for consistent unless it was compared.
+	AuditUnknown AuditState = iota
+
+	// AuditConsistent means memcache holds the same entity, or the same lack
+	// of an entity, as the datastore.
+	AuditConsistent
+
+	// AuditUncached means memcache holds nothing for the key.
+	AuditUncached
+
+	// AuditLocked means memcache holds a lock for the key. Memcache expires
+	// locks itself after the lock time so a lock is never reported as
+	// stuck, only as present.
+	AuditLocked
+
+	// AuditMissingEntity means memcache holds an entity the datastore does
+	// not have.
+	AuditMissingEntity
+
+	// AuditUnexpectedEntity means memcache records that there is no entity
+	// but the datastore has one.
+	AuditUnexpectedEntity
+
+	// AuditMismatch means memcache and the datastore hold different entities.
+	AuditMismatch
+
+	// AuditCorrupt means the memcache item could not be understood, either
+	// because it has unknown flags or its value could not be unmarshaled.
+	AuditCorrupt
+)
+
+// Divergent reports whether the state indicates memcache and the datastore
+// disagree.
+func (s AuditState) Divergent() bool {
+	return s >= AuditMissingEntity
+}
+
+// AuditResult is the outcome of auditing a single key.
+type AuditResult struct {
+	Key   *datastore.Key
+	State AuditState
+}
+
+// Audit reads each key from both memcache and the datastore and reports how
+// they compare, without modifying either. It is an operational tool for
+// checking that the caching strategy is holding in production; a divergent
+// result indicates something has been writing to the datastore without using
+// nds, or a bug in nds itself.
+//
+// Audit is not atomic: an entity modified concurrently with the audit can be
+// reported as divergent. Audit such entities again before acting on a result.
+//
+// The returned results are in the same order as keys. If reading a key from
+// memcache or the datastore fails, its result is AuditUnknown and an
+// appengine.MultiError is returned with the error at that key's index.
+func Audit(c context.Context, keys []*datastore.Key) ([]AuditResult, error) {
+
+	isNilErr, nilErr := false, make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isNilErr {
+		return nil, nilErr
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]AuditResult, len(keys))
+	errs := make([]error, 0, (len(keys)-1)/getMultiLimit+1)
+	for lo := 0; lo < len(keys); lo += getMultiLimit {
+		hi := lo + getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		errs = append(errs,
+			audit(c, memcacheCtx, keys[lo:hi], results[lo:hi]))
+	}
+
+	if isErrorsNil(errs) {
+		return results, nil
+	}
+	return results, groupErrors(errs, len(keys), getMultiLimit)
+}
+
+func audit(c, memcacheCtx context.Context,
+	keys []*datastore.Key, results []AuditResult) error {
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = createMemcacheKey(key)
+		results[i] = AuditResult{Key: key, State: AuditUnknown}
+	}
+
+	items, err := memcacheGetMulti(memcacheCtx, memcacheKeys)
+	if err != nil {
+		return err
+	}
+
+	vals := make([]datastore.PropertyList, len(keys))
+	me := make(appengine.MultiError, len(keys))
+	if err := datastoreGetMulti(c, keys, vals); err != nil {
+		if e, ok := err.(appengine.MultiError); ok {
+			me = e
+		} else {
+			return err
+		}
+	}
+
+	errsNil := true
+	for i := range keys {
+		exists := true
+		switch me[i] {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			exists = false
+		default:
+			errsNil = false
+			continue
+		}
+		me[i] = nil
+
+		results[i].State = auditItem(items[memcacheKeys[i]], vals[i], exists)
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+func auditItem(item *memcache.Item,
+	pl datastore.PropertyList, exists bool) AuditState {
+
+	if item == nil {
+		return AuditUncached
+	}
+
+	switch itemType(item.Flags) {
+	case lockItem:
+		return AuditLocked
+	case noneItem:
+		if exists {
+			return AuditUnexpectedEntity
+		}
+		return AuditConsistent
+	case entityItem:
+		cachedPl := datastore.PropertyList{}
+		if err := unmarshalItem(item, &cachedPl); err != nil {
+			return AuditCorrupt
+		}
+		if !exists {
+			return AuditMissingEntity
+		}
+		if len(cachedPl) == 0 && len(pl) == 0 ||
+			reflect.DeepEqual(cachedPl, pl) {
+			return AuditConsistent
+		}
+		return AuditMismatch
+	default:
+		return AuditCorrupt
+	}
+}
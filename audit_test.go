@@ -0,0 +1,151 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestAudit(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "consistent", 0, nil),
+		datastore.NewKey(c, "Entity", "uncached", 0, nil),
+		datastore.NewKey(c, "Entity", "missing", 0, nil),
+		datastore.NewKey(c, "Entity", "unexpected", 0, nil),
+		datastore.NewKey(c, "Entity", "mismatch", 0, nil),
+	}
+
+	for _, key := range []*datastore.Key{keys[0], keys[2], keys[4]} {
+		if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := datastore.Put(c, keys[1], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache for all but the uncached key.
+	primeKeys := []*datastore.Key{keys[0], keys[2], keys[3], keys[4]}
+	err := nds.GetMulti(c, primeKeys, make([]testEntity, len(primeKeys)))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity error but got", err)
+	}
+
+	// Cause divergence by bypassing nds.
+	if err := datastore.Delete(c, keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, keys[3], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, keys[4], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := nds.Audit(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStates := []nds.AuditState{
+		nds.AuditConsistent,
+		nds.AuditUncached,
+		nds.AuditMissingEntity,
+		nds.AuditUnexpectedEntity,
+		nds.AuditMismatch,
+	}
+	for i, result := range results {
+		if !result.Key.Equal(keys[i]) {
+			t.Fatal("incorrect key", result.Key)
+		}
+		if result.State != expectedStates[i] {
+			t.Fatal("incorrect state", i, result.State, expectedStates[i])
+		}
+		if result.State.Divergent() != (i >= 2) {
+			t.Fatal("incorrect divergence", i)
+		}
+	}
+}
+
+func TestAuditNilKey(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	_, err := nds.Audit(c, []*datastore.Key{nil})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key error but got", err)
+	}
+}
+
+func TestAuditErrors(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedErr := errors.New("expected error")
+
+	// A datastore error for one key leaves only that key unknown.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if err := datastore.GetMulti(c, keys, vals); err != nil {
+			return err
+		}
+		return appengine.MultiError{nil, expectedErr}
+	})
+	results, err := nds.Audit(c, keys)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != nil || me[1] != expectedErr {
+		t.Fatal("expected datastore error but got", err)
+	}
+	if results[0].State != nds.AuditUncached {
+		t.Fatal("incorrect state", results[0].State)
+	}
+	if !results[1].Key.Equal(keys[1]) ||
+		results[1].State != nds.AuditUnknown {
+		t.Fatal("expected unknown result but got", results[1])
+	}
+
+	// A memcache failure leaves every key unknown.
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, expectedErr
+	})
+	results, err = nds.Audit(c, keys)
+	nds.SetMemcacheGetMulti(memcache.GetMulti)
+	if err == nil {
+		t.Fatal("expected memcache error")
+	}
+	for i, result := range results {
+		if !result.Key.Equal(keys[i]) || result.State != nds.AuditUnknown {
+			t.Fatal("expected unknown result but got", result)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package nds
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Codec encodes the entities GetMulti saves to memcache. It must be safe for
+// concurrent use.
+type Codec interface {
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte, pl *datastore.PropertyList) error
+}
+
+// The low byte of a memcache item's flags holds the item type and, for
+// entities, the byte above it holds the id of the codec the entity was
+// encoded with. Codec id zero is the built in gob encoding so entities cached
+// before codecs existed are still read.
+const (
+	itemTypeMask   = 0xff
+	codecFlagShift = 8
+	maxCodecID     = 0xff
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[int]Codec{}
+)
+
+// RegisterCodec makes codec available under id for WithCodec and for reading
+// entities cached with it. id is stored with every entity cached using the
+// codec, so it must stay the same for the codec across deployments and every
+// version of the app sharing memcache must register it. id must be between 1
+// and 255. RegisterCodec panics if id is out of range or already registered
+// and is intended to be called from init functions.
+func RegisterCodec(id int, codec Codec) {
+	if id < 1 || id > maxCodecID {
+		panic(fmt.Sprintf("nds: codec id %d out of range", id))
+	}
+	if codec == nil {
+		panic("nds: RegisterCodec codec is nil")
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[id]; ok {
+		panic(fmt.Sprintf("nds: codec id %d registered twice", id))
+	}
+	codecs[id] = codec
+}
+
+var codecKey = "used for codec id"
+
+// WithCodec returns a context that makes GetMulti and Get encode the entities
+// they save to memcache with the codec registered under id. Entities are
+// always decoded with the codec they were saved with, regardless of the
+// context, so apps can switch codecs without flushing memcache. Entities saved
+// with a codec that is not registered are never returned and are instead read
+// from the datastore, with a warning logged.
+func WithCodec(c context.Context, id int) context.Context {
+	return context.WithValue(c, &codecKey, id)
+}
+
+// itemType returns the type of a memcache item with the codec id removed.
+func itemType(flags uint32) uint32 {
+	return flags & itemTypeMask
+}
+
+// marshalItem encodes pl with the context's codec and returns the data along
+// with the flags to save it under.
+func marshalItem(c context.Context,
+	pl datastore.PropertyList) ([]byte, uint32, error) {
+
+	id, _ := c.Value(&codecKey).(int)
+	if id == 0 {
+		data, err := marshal(pl)
+		return data, entityItem, err
+	}
+
+	codec, err := codecByID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := codec.Marshal(pl)
+	return data, entityItem | uint32(id)<<codecFlagShift, err
+}
+
+// unmarshalItem decodes an entity item with the codec recorded in its flags.
+func unmarshalItem(item *memcache.Item, pl *datastore.PropertyList) error {
+	id := int(item.Flags >> codecFlagShift)
+	if id == 0 {
+		return unmarshal(item.Value, pl)
+	}
+
+	codec, err := codecByID(id)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(item.Value, pl)
+}
+
+func codecByID(id int) (Codec, error) {
+	codecsMu.RLock()
+	codec, ok := codecs[id]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("nds: codec id %d not registered", id)
+	}
+	return codec, nil
+}
@@ -0,0 +1,106 @@
+package nds_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var prefixCodecMarker = []byte("prefix:")
+
+// prefixCodec is gob with a marker so the test can tell it was used.
+type prefixCodec struct{}
+
+func (prefixCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	buf := bytes.NewBuffer(append([]byte{}, prefixCodecMarker...))
+	if err := gob.NewEncoder(buf).Encode(&pl); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (prefixCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	if !bytes.HasPrefix(data, prefixCodecMarker) {
+		return errors.New("missing marker")
+	}
+	data = data[len(prefixCodecMarker):]
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
+}
+
+func init() {
+	nds.RegisterCodec(1, prefixCodec{})
+}
+
+func TestCodec(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		StringVal string
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected duplicate registration to panic")
+			}
+		}()
+		nds.RegisterCodec(1, prefixCodec{})
+	}()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{"one"}, {"two"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := nds.WithCodec(c, 1)
+	if err := nds.Get(cc, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(keys[0])
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem|1<<8 {
+		t.Fatal("incorrect flags", item.Flags)
+	}
+	if !bytes.HasPrefix(item.Value, prefixCodecMarker) {
+		t.Fatal("entity not encoded with codec")
+	}
+
+	// Entities are decoded with the codec they were saved with.
+	val := &testEntity{}
+	if err := nds.Get(c, keys[0], val); err != nil {
+		t.Fatal(err)
+	}
+	if val.StringVal != "one" {
+		t.Fatal("incorrect entity", val)
+	}
+
+	// An unregistered codec is never decoded.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[1]),
+		Flags: nds.EntityItem | 2<<8,
+		Value: []byte("garbage"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	val = &testEntity{}
+	if err := nds.Get(c, keys[1], val); err != nil {
+		t.Fatal(err)
+	}
+	if val.StringVal != "two" {
+		t.Fatal("incorrect entity", val)
+	}
+}
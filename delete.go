@@ -6,6 +6,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
@@ -19,6 +20,10 @@ const deleteMultiLimit = 500
 // to put all the keys. It does this efficiently and concurrently.
 func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 
+	if err := checkMaxKeys(c, len(keys)); err != nil {
+		return err
+	}
+
 	callCount := (len(keys)-1)/deleteMultiLimit + 1
 	errs := make([]error, callCount)
 
@@ -56,9 +61,12 @@ func Delete(c context.Context, key *datastore.Key) error {
 
 func deleteMulti(c context.Context, keys []*datastore.Key) error {
 
+	w := keyWatchFromContext(c)
+
+	lockTime := lockTimeFromContext(c)
 	lockMemcacheItems := []*memcache.Item{}
 	for _, key := range keys {
-		// Worst case scenario is that we lock the entity for memcacheLockTime.
+		// Worst case scenario is that we lock the entity for the lock time.
 		// datastore.Delete will raise the appropriate error.
 		if key == nil || key.Incomplete() {
 			continue
@@ -68,26 +76,86 @@ func deleteMulti(c context.Context, keys []*datastore.Key) error {
 			Key:        createMemcacheKey(key),
 			Flags:      lockItem,
 			Value:      itemLock(),
-			Expiration: memcacheLockTime,
+			Expiration: lockTime,
 		}
 		lockMemcacheItems = append(lockMemcacheItems, item)
+		w.emit(key, item.Key, KeyDelete)
 	}
+	lockMemcacheItems = append(lockMemcacheItems, groupLockItems(c, keys)...)
 
 	memcacheCtx, err := memcacheContext(c)
 	if err != nil {
 		return err
 	}
 
-	// Make sure we can lock memcache with no errors before deleting.
 	if tx, ok := transactionFromContext(c); ok {
 		tx.Lock()
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
 		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
-		lockMemcacheItems); err != nil {
+		return datastoreDeleteMulti(c, keys)
+	}
+
+	if q, ok := invalidationQueueFromContext(c); ok {
+		q.Lock()
+		q.lockMemcacheItems = append(q.lockMemcacheItems,
+			lockMemcacheItems...)
+		q.Unlock()
+		return datastoreDeleteMulti(c, keys)
+	}
+
+	// Make sure we can lock memcache with no errors before deleting.
+	if err := memcacheSetMulti(memcacheCtx, lockMemcacheItems); err != nil {
+		return err
+	}
+
+	err = datastoreDeleteMulti(c, keys)
+	if err == nil || len(lockMemcacheItems) == 0 {
 		return err
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	if deleteLockCleanupFromContext(c) {
+		lockMemcacheKeys := make([]string, len(lockMemcacheItems))
+		for i, item := range lockMemcacheItems {
+			lockMemcacheKeys[i] = item.Key
+		}
+		if derr := memcacheDeleteMulti(memcacheCtx,
+			lockMemcacheKeys); derr != nil {
+			log.Warningf(c, "nds:deleteMulti memcache.DeleteMulti %s", derr)
+		} else {
+			log.Warningf(c, "nds:deleteMulti datastore.DeleteMulti failed "+
+				"so removed %d memcache locks %s", len(lockMemcacheItems), err)
+			return err
+		}
+	}
+
+	log.Warningf(c, "nds:deleteMulti datastore.DeleteMulti failed leaving "+
+		"%d memcache locks outstanding %s", len(lockMemcacheItems), err)
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			w.emit(key, createMemcacheKey(key), KeyLockOutstanding)
+		}
+	}
+	return err
+}
+
+var deleteLockCleanupKey = "used for delete lock cleanup"
+
+// WithDeleteLockCleanup returns a context that makes DeleteMulti and Delete
+// remove the memcache locks they set if the datastore delete fails, rather
+// than leaving them to expire after the lock time. Outstanding locks are
+// harmless as they only stop the entities being cached, but they are reported
+// in the log either way and as KeyLockOutstanding events to WithKeyWatch.
+//
+// Cleanup is not the default because a datastore call can apply its changes
+// even when it reports an error, for example on a timeout. Removing the locks
+// in that case lets a concurrent Get cache an entity that is about to be
+// deleted.
+func WithDeleteLockCleanup(c context.Context) context.Context {
+	return context.WithValue(c, &deleteLockCleanupKey, true)
+}
+
+func deleteLockCleanupFromContext(c context.Context) bool {
+	cleanup, _ := c.Value(&deleteLockCleanupKey).(bool)
+	return cleanup
 }
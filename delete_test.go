@@ -1,8 +1,12 @@
 package nds_test
 
 import (
+	"encoding/binary"
+	"math/rand"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 
@@ -142,3 +146,82 @@ func TestDeleteInTransaction(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDeleteDatastoreFailLocks(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+
+	expectedErr := errors.New("expected error")
+	nds.SetDatastoreDeleteMulti(func(c context.Context,
+		keys []*datastore.Key) error {
+		return expectedErr
+	})
+	defer nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+
+	var events []nds.KeyEventType
+	wc := nds.WithKeyWatch(c, []*datastore.Key{key}, func(e nds.KeyEvent) {
+		events = append(events, e.Type)
+	})
+
+	// Without cleanup the lock is left to expire.
+	if err := nds.Delete(wc, key); err == nil {
+		t.Fatal("expected Delete error")
+	}
+	if len(events) == 0 || events[len(events)-1] != nds.KeyLockOutstanding {
+		t.Fatal("expected outstanding lock event but got", events)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags == nds.EntityItem || item.Flags == nds.NoneItem {
+		t.Fatal("expected lock item but got flags", item.Flags)
+	}
+
+	// With cleanup the lock is removed.
+	events = nil
+	if err := nds.Delete(nds.WithDeleteLockCleanup(wc),
+		key); err != expectedErr {
+		t.Fatal("expected datastore error but got", err)
+	}
+	for _, event := range events {
+		if event == nds.KeyLockOutstanding {
+			t.Fatal("unexpected outstanding lock event")
+		}
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache miss but got", err)
+	}
+}
+
+func BenchmarkItemLockParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nds.ItemLock()
+		}
+	})
+}
+
+// BenchmarkLockedRandLockParallel creates lock values from a single mutex
+// guarded source, as itemLock did with the seeded global math/rand source, for
+// comparison with BenchmarkItemLockParallel.
+func BenchmarkLockedRandLockParallel(b *testing.B) {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock := make([]byte, 4)
+			mu.Lock()
+			binary.LittleEndian.PutUint32(lock, r.Uint32())
+			mu.Unlock()
+		}
+	})
+}
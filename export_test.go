@@ -2,6 +2,7 @@ package nds
 
 import (
 	"reflect"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -14,8 +15,17 @@ var (
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
+	CountItem  = countItem
+
+	LockTimeFromContext        = lockTimeFromContext
+	CountExpirationFromContext = countExpirationFromContext
+
+	QueryKeysItem = queryKeysItem
 
 	MemcacheMaxKeySize = memcacheMaxKeySize
+
+	ItemLock = itemLock
 )
 
 func SetMemcacheAddMulti(f func(c context.Context,
@@ -47,11 +57,33 @@ func SetDatastorePutMulti(f func(c context.Context,
 	datastorePutMulti = f
 }
 
+func SetDatastoreDeleteMulti(f func(c context.Context,
+	keys []*datastore.Key) error) {
+	datastoreDeleteMulti = f
+}
+
 func SetDatastoreGetMulti(f func(c context.Context,
 	keys []*datastore.Key, vals interface{}) error) {
 	datastoreGetMulti = f
 }
 
+func SetQueryGetAll(f func(q *datastore.Query,
+	c context.Context, dst interface{}) ([]*datastore.Key, error)) {
+	queryGetAll = f
+}
+
+func CreateCountMemcacheKey(c context.Context, name string) string {
+	return createCountMemcacheKey(c, name)
+}
+
+func SetQueryCount(f func(q *datastore.Query, c context.Context) (int, error)) {
+	queryCount = f
+}
+
+func SetFrequencyAdmissionNow(fa *FrequencyAdmission, now func() time.Time) {
+	fa.now = now
+}
+
 func SetMarshal(f func(pl datastore.PropertyList) ([]byte, error)) {
 	marshal = f
 }
@@ -64,6 +96,10 @@ func SetValue(val reflect.Value, pl datastore.PropertyList) error {
 	return setValue(val, pl)
 }
 
+func ShortenMemcacheKey(memcacheKey string) string {
+	return shortenMemcacheKey(memcacheKey)
+}
+
 func CreateMemcacheKey(key *datastore.Key) string {
 	return createMemcacheKey(key)
 }
@@ -2,6 +2,7 @@ package nds
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"encoding/binary"
 	"math/rand"
 	"reflect"
@@ -54,14 +55,26 @@ const getMultiLimit = 1000
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
+//
+// Keys that appear more than once in keys are only read from memcache and the
+// datastore once, and the entity is then loaded into every element of vals
+// that asked for it.
 func GetMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) error {
 
+	if err := checkMaxKeys(c, len(keys)); err != nil {
+		return err
+	}
+
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
 		return err
 	}
 
+	if uniqueKeys, index := dedupeKeys(keys); len(uniqueKeys) < len(keys) {
+		return getMultiDuplicates(c, keys, v, uniqueKeys, index)
+	}
+
 	callCount := (len(keys)-1)/getMultiLimit + 1
 	errs := make([]error, callCount)
 
@@ -92,6 +105,57 @@ func GetMulti(c context.Context,
 	return groupErrors(errs, len(keys), getMultiLimit)
 }
 
+// dedupeKeys returns keys with any duplicates removed along with the index in
+// uniqueKeys of each key.
+func dedupeKeys(keys []*datastore.Key) ([]*datastore.Key, []int) {
+	uniqueKeys := make([]*datastore.Key, 0, len(keys))
+	index := make([]int, len(keys))
+	seen := make(map[string]int, len(keys))
+	for i, key := range keys {
+		encoded := key.Encode()
+		j, ok := seen[encoded]
+		if !ok {
+			j = len(uniqueKeys)
+			seen[encoded] = j
+			uniqueKeys = append(uniqueKeys, key)
+		}
+		index[i] = j
+	}
+	return uniqueKeys, index
+}
+
+// getMultiDuplicates gets the property lists of uniqueKeys and then loads them
+// into every element of vals with a matching key. This ensures duplicate keys
+// are only cached or read from the datastore once, even if they would fall in
+// different getMultiLimit batches.
+func getMultiDuplicates(c context.Context, keys []*datastore.Key,
+	vals reflect.Value, uniqueKeys []*datastore.Key, index []int) error {
+
+	pls := make([]datastore.PropertyList, len(uniqueKeys))
+	err := GetMulti(c, uniqueKeys, pls)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, j := range index {
+		if ok && me[j] != nil {
+			errs[i] = me[j]
+		} else if err := setValue(vals.Index(i), pls[j]); err != nil {
+			errs[i] = err
+		}
+		if errs[i] != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
 // Get loads the entity stored for key into val, which must be a struct pointer.
 // Currently PropertyLoadSaver is not implemented. If there is no such entity
 // for the key, Get returns ErrNoSuchEntity.
@@ -166,6 +230,14 @@ func getMulti(c context.Context,
 	log.Infof(c, "locking memcache items")
 	lockMemcache(memcacheCtx, cacheItems)
 
+	hits := int64(0)
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == done {
+			hits++
+		}
+	}
+	cacheStatsFromContext(c).add(hits, int64(len(cacheItems))-hits, 0)
+
 	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
 		return err
 	}
@@ -204,32 +276,46 @@ func loadMemcache(c context.Context, cacheItems []cacheItem) {
 		return
 	}
 
+	w := keyWatchFromContext(c)
+	s := cacheStatsFromContext(c)
+
 	log.Infof(c, "iterating memcache keys")
 	for i, memcacheKey := range memcacheKeys {
-		if item, ok := items[memcacheKey]; ok {
-			switch item.Flags {
-			case lockItem:
+		item, ok := items[memcacheKey]
+		if !ok {
+			w.emit(cacheItems[i].key, memcacheKey, KeyCacheMiss)
+			continue
+		}
+
+		switch itemType(item.Flags) {
+		case lockItem:
+			cacheItems[i].state = externalLock
+		case noneItem:
+			cacheItems[i].state = done
+			cacheItems[i].err = datastore.ErrNoSuchEntity
+		case entityItem:
+			pl := datastore.PropertyList{}
+			if err := unmarshalItem(item, &pl); err != nil {
+				log.Warningf(c, "nds:loadMemcache unmarshal %s", err)
 				cacheItems[i].state = externalLock
-			case noneItem:
+				break
+			}
+			if err := setValue(cacheItems[i].val, pl); err == nil {
 				cacheItems[i].state = done
-				cacheItems[i].err = datastore.ErrNoSuchEntity
-			case entityItem:
-				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
-					log.Warningf(c, "nds:loadMemcache unmarshal %s", err)
-					cacheItems[i].state = externalLock
-					break
-				}
-				if err := setValue(cacheItems[i].val, pl); err == nil {
-					cacheItems[i].state = done
-				} else {
-					log.Warningf(c, "nds:loadMemcache setValue %s", err)
-					cacheItems[i].state = externalLock
-				}
-			default:
-				log.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+			} else {
+				log.Warningf(c, "nds:loadMemcache setValue %s", err)
 				cacheItems[i].state = externalLock
 			}
+		default:
+			log.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+			cacheItems[i].state = externalLock
+		}
+
+		if cacheItems[i].state == done {
+			w.emit(cacheItems[i].key, memcacheKey, KeyCacheHit)
+		} else if item.Flags == lockItem {
+			w.emit(cacheItems[i].key, memcacheKey, KeyCacheLocked)
+			s.add(0, 0, 1)
 		}
 	}
 }
@@ -239,19 +325,42 @@ func loadMemcache(c context.Context, cacheItems []cacheItem) {
 // created. This is only important when multiple calls of Get/GetMulti are
 // performed concurrently for the same previously uncached entity.
 func itemLock() []byte {
+	r := lockRandPool.Get().(*rand.Rand)
 	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, rand.Uint32())
+	binary.LittleEndian.PutUint32(b, r.Uint32())
+	lockRandPool.Put(r)
 	return b
 }
 
-func init() {
-	// Seed the pseudorandom number generator to reduce the chance of itemLock
-	// collisions.
-	rand.Seed(time.Now().UnixNano())
+// lockRandPool holds the pseudorandom number generators used by itemLock.
+// Pooling them avoids contending on the lock around the global math/rand
+// source when many locks are created concurrently. Each is seeded from
+// crypto/rand so lock values are unpredictable across instances and restarts.
+var lockRandPool = sync.Pool{
+	New: func() interface{} {
+		var seed int64
+		if err := binary.Read(crand.Reader, binary.LittleEndian,
+			&seed); err != nil {
+			seed = time.Now().UnixNano()
+		}
+		return rand.New(rand.NewSource(seed))
+	},
 }
 
 func lockMemcache(c context.Context, cacheItems []cacheItem) {
 
+	// Entities the admission policy rejects are read from the datastore
+	// without locking so that they are never saved to memcache.
+	if policy := admissionPolicyFromContext(c); policy != nil {
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == miss &&
+				!policy.Admit(cacheItem.memcacheKey) {
+				cacheItems[i].state = externalLock
+			}
+		}
+	}
+
+	lockTime := lockTimeFromContext(c)
 	lockItems := make([]*memcache.Item, 0, len(cacheItems))
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
@@ -261,7 +370,7 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 				Key:        cacheItem.memcacheKey,
 				Flags:      lockItem,
 				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+				Expiration: lockTime,
 			}
 			cacheItems[i].item = item
 			lockItems = append(lockItems, item)
@@ -288,24 +397,31 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 		return
 	}
 
+	w := keyWatchFromContext(c)
+	s := cacheStatsFromContext(c)
+
 	// Cache worked so figure out what items we got.
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
 			if item, ok := items[cacheItem.memcacheKey]; ok {
-				switch item.Flags {
+				switch itemType(item.Flags) {
 				case lockItem:
 					if bytes.Equal(item.Value, cacheItem.item.Value) {
 						cacheItems[i].item = item
 						cacheItems[i].state = internalLock
+						w.emit(cacheItem.key, cacheItem.memcacheKey, KeyLock)
 					} else {
 						cacheItems[i].state = externalLock
+						w.emit(cacheItem.key, cacheItem.memcacheKey,
+							KeyCacheLocked)
+						s.add(0, 0, 1)
 					}
 				case noneItem:
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
 				case entityItem:
 					pl := datastore.PropertyList{}
-					if err := unmarshal(item.Value, &pl); err != nil {
+					if err := unmarshalItem(item, &pl); err != nil {
 						log.Warningf(c, "nds:lockMemcache unmarshal %s", err)
 						cacheItems[i].state = externalLock
 						break
@@ -321,6 +437,11 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 						item.Flags)
 					cacheItems[i].state = externalLock
 				}
+
+				// Another call cached the entity since loadMemcache.
+				if cacheItems[i].state == done {
+					w.emit(cacheItem.key, cacheItem.memcacheKey, KeyCacheHit)
+				}
 			} else {
 				// We just added a memcache item but it now isn't available so
 				// treat it as an extarnal lock.
@@ -365,9 +486,9 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 			}
 
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
 				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
+				if data, flags, err := marshalItem(c, pl); err == nil {
+					cacheItems[index].item.Flags = flags
 					cacheItems[index].item.Value = data
 				} else {
 					cacheItems[index].state = externalLock
@@ -377,7 +498,8 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 		case datastore.ErrNoSuchEntity:
 			if cacheItems[index].state == internalLock {
 				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
+				cacheItems[index].item.Expiration =
+					noSuchEntityExpirationFromContext(c)
 				cacheItems[index].item.Value = []byte{}
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
@@ -392,13 +514,108 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 func saveMemcache(c context.Context, cacheItems []cacheItem) {
 
 	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	saveKeys := make([]*datastore.Key, 0, len(cacheItems))
 	for _, cacheItem := range cacheItems {
 		if cacheItem.state == internalLock {
 			saveItems = append(saveItems, cacheItem.item)
+			saveKeys = append(saveKeys, cacheItem.key)
+		}
+	}
+
+	err := memcacheCompareAndSwapMulti(c, saveItems)
+	me, ok := err.(appengine.MultiError)
+
+	if w := keyWatchFromContext(c); w != nil && (err == nil || ok) {
+		for i, item := range saveItems {
+			switch {
+			case err == nil || me[i] == nil:
+				w.emit(saveKeys[i], item.Key, KeyCacheFill)
+			case me[i] == memcache.ErrCASConflict:
+				w.emit(saveKeys[i], item.Key, KeyCASConflict)
+			}
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
-		log.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	if err == nil {
+		return
 	}
+	log.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+
+	if !ok || lockExpiryPolicyFromContext(c) != OptimisticLockExpiry {
+		return
+	}
+
+	// Our lock expired or was evicted before we could swap it so only add the
+	// items back if nothing else has taken their place in the meantime.
+	addItems := make([]*memcache.Item, 0, len(saveItems))
+	for i, item := range saveItems {
+		if me[i] == memcache.ErrNotStored {
+			addItems = append(addItems, &memcache.Item{
+				Key:        item.Key,
+				Flags:      item.Flags,
+				Value:      item.Value,
+				Expiration: item.Expiration,
+			})
+		}
+	}
+
+	if err := memcacheAddMulti(c, addItems); err != nil {
+		log.Warningf(c, "nds:saveMemcache AddMulti %s", err)
+	}
+}
+
+var noSuchEntityExpirationKey = "used for no such entity expiration"
+
+// WithNoSuchEntityExpiration returns a context that makes GetMulti and Get
+// expire the memcache records of entities the datastore reported as
+// datastore.ErrNoSuchEntity after d. By default these records never expire,
+// like cached entities, as PutMulti and DeleteMulti replace them whenever the
+// key is written. A short expiration limits how long keys that are only ever
+// looked up once occupy memcache.
+func WithNoSuchEntityExpiration(c context.Context,
+	d time.Duration) context.Context {
+	return context.WithValue(c, &noSuchEntityExpirationKey, d)
+}
+
+func noSuchEntityExpirationFromContext(c context.Context) time.Duration {
+	d, _ := c.Value(&noSuchEntityExpirationKey).(time.Duration)
+	return d
+}
+
+// LockExpiryPolicy determines what GetMulti does when the memcache lock it
+// placed on an entity has expired or been evicted by the time it tries to
+// fill memcache with the entity it loaded from the datastore.
+type LockExpiryPolicy int
+
+const (
+	// StrictLockExpiry abandons the memcache fill when the lock is no longer
+	// present. The entity is still returned to the caller but it will not be
+	// cached until a later GetMulti succeeds in locking and filling it. This
+	// is the default and never caches stale entities.
+	StrictLockExpiry LockExpiryPolicy = iota
+
+	// OptimisticLockExpiry adds the entity to memcache anyway if the lock is
+	// no longer present and no other item has replaced it. This can cache
+	// stale entities whenever writes run concurrently with reads: PutMulti
+	// removes its lock as soon as its datastore write completes, so a Put
+	// that starts and finishes after GetMulti loads the entity but before it
+	// fills memcache leaves no trace, and the older entity is cached until
+	// the next Put or Delete of that key. This is independent of the lock
+	// time and should only be used for entities that can tolerate stale
+	// reads.
+	OptimisticLockExpiry
+)
+
+var lockExpiryPolicyKey = "used for LockExpiryPolicy"
+
+// WithLockExpiryPolicy returns a context that makes GetMulti and Get use the
+// given LockExpiryPolicy. Contexts without a policy use StrictLockExpiry.
+func WithLockExpiryPolicy(c context.Context,
+	policy LockExpiryPolicy) context.Context {
+	return context.WithValue(c, &lockExpiryPolicyKey, policy)
+}
+
+func lockExpiryPolicyFromContext(c context.Context) LockExpiryPolicy {
+	policy, _ := c.Value(&lockExpiryPolicyKey).(LockExpiryPolicy)
+	return policy
 }
@@ -4,6 +4,7 @@ import (
 	"io"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 
@@ -762,6 +763,53 @@ func TestGetNamespacedKey(t *testing.T) {
 	}
 }
 
+// Entities cached for a key in one namespace must not be served for the same
+// key in another.
+func TestGetNamespaceIsolation(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	aCtx, err := appengine.Namespace(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bCtx, err := appengine.Namespace(c, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aKey := datastore.NewKey(aCtx, "Entity", "x", 0, nil)
+	bKey := datastore.NewKey(bCtx, "Entity", "x", 0, nil)
+
+	if nds.CreateMemcacheKey(aKey) == nds.CreateMemcacheKey(bKey) {
+		t.Fatal("namespaces share a memcache key")
+	}
+
+	if _, err := nds.Put(aCtx, aKey, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(aCtx, aKey, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []nds.KeyEvent
+	wc := nds.WithKeyWatch(bCtx, []*datastore.Key{bKey}, func(e nds.KeyEvent) {
+		events = append(events, e)
+	})
+	if err := nds.Get(wc, bKey, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity but got", err)
+	}
+	if len(events) == 0 || events[0].Type != nds.KeyCacheMiss {
+		t.Fatal("expected a cache miss but got", events)
+	}
+}
+
 func TestGetMultiPaths(t *testing.T) {
 	expectedErr := errors.New("expected error")
 
@@ -1322,3 +1370,314 @@ func TestGetMultiFieldMismatch(t *testing.T) {
 		}
 	}
 }
+
+func TestGetLockExpiryPolicy(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+
+	// Simulate the GetMulti lock expiring just before the memcache fill.
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		if err := memcache.Delete(c, memcacheKey); err != nil {
+			return err
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	tests := []struct {
+		policy nds.LockExpiryPolicy
+		cached bool
+	}{
+		{nds.StrictLockExpiry, false},
+		{nds.OptimisticLockExpiry, true},
+	}
+
+	for _, test := range tests {
+		if err := memcache.Delete(c, memcacheKey); err != nil &&
+			err != memcache.ErrCacheMiss {
+			t.Fatal(err)
+		}
+
+		entity := &testEntity{}
+		pc := nds.WithLockExpiryPolicy(c, test.policy)
+		if err := nds.Get(pc, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 42 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+
+		item, err := memcache.Get(c, memcacheKey)
+		if !test.cached {
+			if err != memcache.ErrCacheMiss {
+				t.Fatal("expected memcache miss but got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != nds.EntityItem {
+			t.Fatal("expected entity item but got flags", item.Flags)
+		}
+	}
+
+	// A Put that locks, writes and unlocks the entity between the datastore
+	// read and the memcache fill removes its own lock, so the optimistic
+	// policy caches the entity from before the Put.
+	staleTests := []struct {
+		policy nds.LockExpiryPolicy
+		stale  bool
+	}{
+		{nds.StrictLockExpiry, false},
+		{nds.OptimisticLockExpiry, true},
+	}
+
+	for _, test := range staleTests {
+		if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Put locks, writes and unlocks the entity just before the fill.
+		nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+			items []*memcache.Item) error {
+			if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+				return err
+			}
+			return memcache.CompareAndSwapMulti(c, items)
+		})
+
+		entity := &testEntity{}
+		pc := nds.WithLockExpiryPolicy(c, test.policy)
+		err := nds.Get(pc, key, entity)
+		nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+
+		_, err = memcache.Get(c, memcacheKey)
+		if !test.stale {
+			if err != memcache.ErrCacheMiss {
+				t.Fatal("expected memcache miss but got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The entity from before the Put is now cached.
+		entity = &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("expected stale IntVal but got", entity.IntVal)
+		}
+	}
+}
+
+func TestGetMultiTooManyKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	entities := make([]testEntity, len(keys))
+
+	mc := nds.WithMaxKeys(c, 2)
+	if err := nds.GetMulti(mc, keys, entities); err != nds.ErrTooManyKeys {
+		t.Fatal("expected too many keys error but got", err)
+	}
+	if _, err := nds.PutMulti(mc, keys, entities); err != nds.ErrTooManyKeys {
+		t.Fatal("expected too many keys error but got", err)
+	}
+	if err := nds.DeleteMulti(mc, keys); err != nds.ErrTooManyKeys {
+		t.Fatal("expected too many keys error but got", err)
+	}
+
+	// No limit.
+	err := nds.GetMulti(nds.WithMaxKeys(c, 0), keys, entities)
+	if _, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected no such entity errors but got", err)
+	}
+
+	// Default limit.
+	keys = make([]*datastore.Key, 100001)
+	entities = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, entities); err != nds.ErrTooManyKeys {
+		t.Fatal("expected too many keys error but got", err)
+	}
+}
+
+func TestGetNoSuchEntityExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	var expiration time.Duration
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Flags == nds.NoneItem {
+				expiration = item.Expiration
+			}
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	ec := nds.WithNoSuchEntityExpiration(c, time.Minute)
+	if err := nds.Get(ec, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity error but got", err)
+	}
+	if expiration != time.Minute {
+		t.Fatal("incorrect expiration", expiration)
+	}
+
+	// Writes must still replace the record.
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(ec, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+func TestGetMultiDuplicateKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	missingKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKeyCount := 0
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		memcacheKeyCount += len(keys)
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	datastoreKeyCount := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreKeyCount += len(keys)
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	keys := []*datastore.Key{key, missingKey, key, missingKey, key}
+	for i := 0; i < 2; i++ {
+		memcacheKeyCount, datastoreKeyCount = 0, 0
+
+		vals := make([]*testEntity, len(keys))
+		for j := range vals {
+			vals[j] = &testEntity{}
+		}
+		err := nds.GetMulti(c, keys, vals)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		for j := range keys {
+			if keys[j] == missingKey {
+				if me[j] != datastore.ErrNoSuchEntity {
+					t.Fatal("expected ErrNoSuchEntity", me[j])
+				}
+			} else if me[j] != nil || vals[j].IntVal != 42 {
+				t.Fatal("incorrect entity", j, me[j], vals[j])
+			}
+		}
+
+		// The first GetMulti looks up and then locks both keys, the second
+		// finds them both cached.
+		expectedMemcacheKeyCount, expectedDatastoreKeyCount := 4, 2
+		if i > 0 {
+			expectedMemcacheKeyCount, expectedDatastoreKeyCount = 2, 0
+		}
+		if memcacheKeyCount != expectedMemcacheKeyCount {
+			t.Fatal("incorrect memcache key count", memcacheKeyCount)
+		}
+		if datastoreKeyCount != expectedDatastoreKeyCount {
+			t.Fatal("incorrect datastore key count", datastoreKeyCount)
+		}
+	}
+}
+
+func TestGetMultiDuplicateKeysAcrossBatches(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	datastoreKeyCount := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreKeyCount += len(keys)
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// More than one GetMulti batch worth of the same key.
+	keys := make([]*datastore.Key, 1500)
+	for i := range keys {
+		keys[i] = key
+	}
+	vals := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, vals); err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range vals {
+		if val.IntVal != 42 {
+			t.Fatal("incorrect entity", i, val)
+		}
+	}
+	if datastoreKeyCount != 1 {
+		t.Fatal("expected 1 datastore key but got", datastoreKeyCount)
+	}
+}
@@ -1,7 +1,14 @@
 module github.com/qedus/nds
 
+go 1.27.1
+
 require (
 	golang.org/x/net v0.0.0-20181107093936-a544f70c90f1
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
 	google.golang.org/appengine v1.3.0
 )
+
+require (
+	github.com/golang/protobuf v1.2.0 // indirect
+	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
+	golang.org/x/text v0.3.0 // indirect
+)
@@ -0,0 +1,72 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var invalidationQueueKey = "used for *invalidationQueue"
+
+type invalidationQueue struct {
+	sync.Mutex
+	lockMemcacheItems []*memcache.Item
+}
+
+func invalidationQueueFromContext(c context.Context) (*invalidationQueue, bool) {
+	q, ok := c.Value(&invalidationQueueKey).(*invalidationQueue)
+	return q, ok
+}
+
+// WithInvalidationQueue returns a context in which PutMulti, Put, DeleteMulti
+// and Delete queue their memcache locks instead of setting them before each
+// datastore call. The queued locks are then set in a single memcache call by
+// FlushInvalidations. This saves memcache calls for requests that write many
+// entities, in the same way RunInTransaction does.
+//
+// This weakens the consistency guarantees of nds. Entities written using the
+// returned context are written to the datastore immediately but memcache is
+// only invalidated by FlushInvalidations, so until then any Get can return
+// the entity as it was before the write. FlushInvalidations must be called
+// once all writes have completed; entities written without it being called
+// will stay stale in memcache.
+//
+// Writes within RunInTransaction are unaffected as they are already queued
+// until the transaction commits.
+func WithInvalidationQueue(c context.Context) context.Context {
+	return context.WithValue(c, &invalidationQueueKey, &invalidationQueue{})
+}
+
+// FlushInvalidations sets the memcache locks queued by writes made with a
+// context returned from WithInvalidationQueue, invalidating the cached
+// entities. The locks are set in the order their writes were queued and expire
+// after the lock time of the context they were written with. The queue is
+// emptied so FlushInvalidations can be called again after further writes. It
+// does nothing if c has no queue.
+func FlushInvalidations(c context.Context) error {
+	q, ok := invalidationQueueFromContext(c)
+	if !ok {
+		return nil
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	lockMemcacheItems := q.lockMemcacheItems
+	q.lockMemcacheItems = nil
+	q.Unlock()
+
+	if err := memcacheSetMulti(memcacheCtx, lockMemcacheItems); err != nil {
+		// Put the locks back so a retry can flush them.
+		q.Lock()
+		q.lockMemcacheItems = append(lockMemcacheItems,
+			q.lockMemcacheItems...)
+		q.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestFlushInvalidations(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	entities := []testEntity{{1}, {1}, {1}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	setMultiCalls := [][]*memcache.Item{}
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		setMultiCalls = append(setMultiCalls, items)
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	qc := nds.WithInvalidationQueue(c)
+	if _, err := nds.Put(qc, keys[0], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(qc, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Delete(qc, keys[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setMultiCalls) != 0 {
+		t.Fatal("expected no memcache.SetMulti calls before flush")
+	}
+
+	if err := nds.FlushInvalidations(qc); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setMultiCalls) != 1 {
+		t.Fatal("expected one memcache.SetMulti call but got",
+			len(setMultiCalls))
+	}
+
+	// Each write queues an entity lock followed by its entity group lock.
+	if len(setMultiCalls[0]) != 2*len(keys) {
+		t.Fatal("expected all locks in one call but got",
+			len(setMultiCalls[0]))
+	}
+	for i, key := range keys {
+		if setMultiCalls[0][2*i].Key != nds.CreateMemcacheKey(key) {
+			t.Fatal("locks flushed out of order")
+		}
+	}
+
+	nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	getEntities := make([]testEntity, len(keys))
+	err := nds.GetMulti(c, keys, getEntities)
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity error but got", err)
+	}
+	for i := 0; i < 2; i++ {
+		if getEntities[i].IntVal != 2 {
+			t.Fatal("incorrect IntVal", getEntities[i].IntVal)
+		}
+	}
+}
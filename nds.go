@@ -3,6 +3,8 @@ package nds
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
@@ -19,17 +21,35 @@ const (
 	// memcachePrefix is the namespace memcache uses to store entities.
 	memcachePrefix = "NDS1:"
 
-	// memcacheLockTime is the maximum length of time a memcache lock will be
-	// held for. 32 seconds is chosen as 30 seconds is the maximum amount of
-	// time an underlying datastore call will retry even if the API reports a
-	// success to the user.
+	// memcacheGroupPrefix, memcacheQueryPrefix and memcacheCountPrefix are
+	// the namespaces memcache uses to store entity group tokens, cached query
+	// results and cached counts. Encoded datastore keys never contain a colon
+	// so these cannot collide with entities.
+	memcacheGroupPrefix = memcachePrefix + "G:"
+	memcacheQueryPrefix = memcachePrefix + "Q:"
+	memcacheCountPrefix = memcachePrefix + "C:"
+
+	// memcacheLockTime is the default maximum length of time a memcache lock
+	// will be held for. 32 seconds is chosen as 30 seconds is the maximum
+	// amount of time an underlying datastore call will retry even if the API
+	// reports a success to the user.
 	memcacheLockTime = 32 * time.Second
 
 	// memcacheMaxKeySize is the maximum size a memcache item key can be. Keys
 	// greater than this size are automatically hashed to a smaller size.
 	memcacheMaxKeySize = 250
+
+	// defaultMaxKeys is the maximum number of keys GetMulti, PutMulti and
+	// DeleteMulti accept in a single call unless changed with WithMaxKeys.
+	// It is high enough not to affect normal use but stops a pathological
+	// call from allocating unbounded memory.
+	defaultMaxKeys = 100000
 )
 
+// ErrTooManyKeys is returned by GetMulti, PutMulti and DeleteMulti when they
+// are called with more keys than the context allows. See WithMaxKeys.
+var ErrTooManyKeys = errors.New("nds: too many keys")
+
 var (
 	typeOfPropertyLoadSaver = reflect.TypeOf(
 		(*datastore.PropertyLoadSaver)(nil)).Elem()
@@ -43,6 +63,9 @@ var (
 	datastoreGetMulti    = datastore.GetMulti
 	datastorePutMulti    = datastore.PutMulti
 
+	queryGetAll = (*datastore.Query).GetAll
+	queryCount  = (*datastore.Query).Count
+
 	memcacheAddMulti            = memcache.AddMulti
 	memcacheCompareAndSwapMulti = memcache.CompareAndSwapMulti
 	memcacheDeleteMulti         = memcache.DeleteMulti
@@ -61,6 +84,9 @@ const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+	groupTokenItem
+	queryKeysItem
+	countItem
 )
 
 func init() {
@@ -131,6 +157,58 @@ func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 	return nil
 }
 
+var maxKeysKey = "used for max keys"
+
+// WithMaxKeys returns a context that limits GetMulti, PutMulti and
+// DeleteMulti to n keys per call, returning ErrTooManyKeys if there are more.
+// A limit of zero or less removes the limit. Contexts without a limit use
+// defaultMaxKeys.
+func WithMaxKeys(c context.Context, n int) context.Context {
+	return context.WithValue(c, &maxKeysKey, n)
+}
+
+func checkMaxKeys(c context.Context, count int) error {
+	maxKeys, ok := c.Value(&maxKeysKey).(int)
+	if !ok {
+		maxKeys = defaultMaxKeys
+	}
+	if maxKeys > 0 && count > maxKeys {
+		return ErrTooManyKeys
+	}
+	return nil
+}
+
+var lockTimeKey = "used for lock time"
+
+// WithLockTime returns a context that makes the memcache locks set by
+// GetMulti, PutMulti and DeleteMulti expire after d rather than
+// memcacheLockTime. A d of zero or less uses memcacheLockTime. Memcache only
+// expires items in whole seconds and treats anything under a second as
+// already expired, so d is rounded up to a whole number of seconds.
+//
+// d should comfortably exceed the slowest datastore call the app makes. If a
+// lock expires before the write it guards completes, a concurrent Get can
+// cache the entity as it was before the write. The longer d is, the longer an
+// entity stays uncached after a writer crashes or a DeleteMulti completes, as
+// its lock is left to expire.
+func WithLockTime(c context.Context, d time.Duration) context.Context {
+	if rem := d % time.Second; d > 0 && rem != 0 {
+		d += time.Second - rem
+	}
+	return context.WithValue(c, &lockTimeKey, d)
+}
+
+func lockTimeFromContext(c context.Context) time.Duration {
+	if d, ok := c.Value(&lockTimeKey).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return memcacheLockTime
+}
+
+// createMemcacheKey replaces keys that are too long for memcache with their
+// sha1 hex digest. This derivation must not change without bumping
+// memcachePrefix, as instances running different versions of nds share
+// memcache during a deploy and must agree on the keys they lock.
 func createMemcacheKey(key *datastore.Key) string {
 	memcacheKey := memcachePrefix + key.Encode()
 	if len(memcacheKey) > memcacheMaxKeySize {
@@ -140,6 +218,20 @@ func createMemcacheKey(key *datastore.Key) string {
 	return memcacheKey
 }
 
+// shortenMemcacheKey shortens memcacheKey if it is too long to be used as a
+// memcache key. The start of the key is kept, so it still shows which prefix
+// it was created with when inspecting memcache, and the rest is replaced by a
+// hash of the whole key. It is used for keys other than entities, which have
+// no older derivation to stay compatible with.
+func shortenMemcacheKey(memcacheKey string) string {
+	if len(memcacheKey) > memcacheMaxKeySize {
+		hash := sha256.Sum256([]byte(memcacheKey))
+		suffix := "#" + base64.RawURLEncoding.EncodeToString(hash[:])
+		memcacheKey = memcacheKey[:memcacheMaxKeySize-len(suffix)] + suffix
+	}
+	return memcacheKey
+}
+
 func memcacheContext(c context.Context) (context.Context, error) {
 	return appengine.Namespace(c, memcacheNamespace)
 }
@@ -1,10 +1,12 @@
 package nds_test
 
 import (
+	"crypto/sha1"
 	"encoding/hex"
 	"math/rand"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -634,6 +636,90 @@ func TestCreateMemcacheKey(t *testing.T) {
 	if len(memcacheKey) > maxKeySize {
 		t.Fatal("incorrect memcache key size")
 	}
+
+	// Instances running older versions must derive the same key.
+	hash := sha1.Sum([]byte("NDS1:" + key.Encode()))
+	if memcacheKey != hex.EncodeToString(hash[:]) {
+		t.Fatal("memcache key derivation changed", memcacheKey)
+	}
+}
+
+func TestShortenMemcacheKey(t *testing.T) {
+	maxKeySize := nds.MemcacheMaxKeySize
+
+	short := "NDS1:G:short"
+	if nds.ShortenMemcacheKey(short) != short {
+		t.Fatal("short key was changed")
+	}
+
+	long := "NDS1:G:" + randHexString(maxKeySize)
+	shortened := nds.ShortenMemcacheKey(long)
+	if len(shortened) > maxKeySize {
+		t.Fatal("incorrect memcache key size", len(shortened))
+	}
+	if !strings.HasPrefix(shortened, "NDS1:G:") {
+		t.Fatal("shortened memcache key lost its prefix", shortened)
+	}
+	if nds.ShortenMemcacheKey(long+"x") == shortened {
+		t.Fatal("shortened memcache keys collide")
+	}
+}
+
+func TestLongAncestorKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	// Build two ancestor chains that only differ in their deepest key, so
+	// their encodings share a prefix far longer than a memcache key.
+	var parent *datastore.Key
+	for i := 0; i < 50; i++ {
+		parent = datastore.NewKey(c, "Parent", "", int64(i+1), parent)
+	}
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+
+	memcacheKeys := []string{
+		nds.CreateMemcacheKey(keys[0]),
+		nds.CreateMemcacheKey(keys[1]),
+	}
+	for _, memcacheKey := range memcacheKeys {
+		if len(memcacheKey) > nds.MemcacheMaxKeySize {
+			t.Fatal("incorrect memcache key size", len(memcacheKey))
+		}
+	}
+	if memcacheKeys[0] == memcacheKeys[1] {
+		t.Fatal("memcache keys collide")
+	}
+
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get twice so the second is served from memcache.
+	for i := 0; i < 2; i++ {
+		vals := make([]testEntity, len(keys))
+		if err := nds.GetMulti(c, keys, vals); err != nil {
+			t.Fatal(err)
+		}
+		if vals[0].IntVal != 1 || vals[1].IntVal != 2 {
+			t.Fatal("incorrect entities", vals)
+		}
+	}
+
+	items, err := memcache.GetMulti(c, memcacheKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(memcacheKeys) {
+		t.Fatal("expected entities to be cached")
+	}
 }
 
 func TestMemcacheNamespace(t *testing.T) {
@@ -27,6 +27,10 @@ func PutMulti(c context.Context,
 		return nil, nil
 	}
 
+	if err := checkMaxKeys(c, len(keys)); err != nil {
+		return nil, err
+	}
+
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
 		return nil, err
@@ -119,6 +123,9 @@ func Put(c context.Context,
 func putMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
+	w := keyWatchFromContext(c)
+
+	lockTime := lockTimeFromContext(c)
 	lockMemcacheKeys := make([]string, 0, len(keys))
 	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
 	for _, key := range keys {
@@ -127,20 +134,29 @@ func putMulti(c context.Context,
 				Key:        createMemcacheKey(key),
 				Flags:      lockItem,
 				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+				Expiration: lockTime,
 			}
 			lockMemcacheItems = append(lockMemcacheItems, item)
 			lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+			w.emit(key, item.Key, KeyPut)
 		}
 	}
 
+	for _, item := range groupLockItems(c, keys) {
+		lockMemcacheItems = append(lockMemcacheItems, item)
+		lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+	}
+
 	memcacheCtx, err := memcacheContext(c)
 	if err != nil {
 		return nil, err
 	}
 
+	_, inTransaction := transactionFromContext(c)
+	_, inQueue := invalidationQueueFromContext(c)
+
 	defer func() {
-		if _, ok := transactionFromContext(c); !ok {
+		if !inTransaction && !inQueue {
 			// Remove the locks.
 			if err := memcacheDeleteMulti(memcacheCtx,
 				lockMemcacheKeys); err != nil {
@@ -154,6 +170,11 @@ func putMulti(c context.Context,
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
 		tx.Unlock()
+	} else if q, ok := invalidationQueueFromContext(c); ok {
+		q.Lock()
+		q.lockMemcacheItems = append(q.lockMemcacheItems,
+			lockMemcacheItems...)
+		q.Unlock()
 	} else if err := memcacheSetMulti(memcacheCtx,
 		lockMemcacheItems); err != nil {
 		return nil, err
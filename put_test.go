@@ -4,6 +4,7 @@ import (
 	"errors"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 	"golang.org/x/net/context"
@@ -225,3 +226,64 @@ func TestPutMultiZeroKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPutMultiLockTime(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lockTime := 5 * time.Second
+	lockCount := 0
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Flags != nds.LockItem {
+				continue
+			}
+			if item.Expiration != lockTime {
+				t.Fatal("incorrect lock expiration", item.Expiration)
+			}
+			lockCount++
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	lc := nds.WithLockTime(c, lockTime)
+	key := datastore.NewKey(c, "Test", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Delete(lc, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entity and group locks for both the put and the delete.
+	if lockCount != 4 {
+		t.Fatal("expected 4 locks but got", lockCount)
+	}
+}
+
+func TestWithLockTime(t *testing.T) {
+	c := context.Background()
+	for _, test := range []struct {
+		d, lockTime time.Duration
+	}{
+		{0, 32 * time.Second},
+		{-time.Second, 32 * time.Second},
+		{time.Nanosecond, time.Second},
+		{500 * time.Millisecond, time.Second},
+		{time.Second, time.Second},
+		{1500 * time.Millisecond, 2 * time.Second},
+		{time.Minute, time.Minute},
+	} {
+		lockTime := nds.LockTimeFromContext(nds.WithLockTime(c, test.d))
+		if lockTime != test.lockTime {
+			t.Fatal("expected lock time", test.lockTime, "for", test.d,
+				"but got", lockTime)
+		}
+	}
+}
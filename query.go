@@ -0,0 +1,379 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// GetAll runs q as an ancestor query for ancestor and caches the keys it
+// returns in memcache under name, so repeated calls do not run the query. If
+// dst is not nil the entities are then loaded with GetMulti and appended to
+// dst, which must be a pointer to a slice accepted by GetMulti. The keys are
+// returned in query order.
+//
+// If GetMulti returns an appengine.MultiError, the keys are still returned and
+// every entity is still appended to dst, along with the error, so callers can
+// use the entities that did load. A datastore.ErrNoSuchEntity in the error
+// means the cached keys were stale, so the cached result is removed and the
+// next call runs the query again.
+//
+// Only ancestor queries are cached as they are the only strongly consistent
+// datastore queries. q is run as a keys-only query and must not already have
+// an ancestor. name must uniquely identify q's filters and orders amongst the
+// queries cached for ancestor's entity group; calls with the same ancestor and
+// name are assumed to run the same query.
+//
+// Cached results are invalidated whenever PutMulti or DeleteMulti write any
+// entity in ancestor's entity group, using a lock per entity group that is
+// set alongside the entity locks. This costs every write an extra memcache
+// item per entity group, and after DeleteMulti or a transaction the group
+// lock is left to expire, so GetAll does not cache results for that group
+// until the lock time has passed. Apps that never use GetAll can avoid these
+// costs with WithoutGroupLocks.
+//
+// Writes that bypass nds, or that use WithoutGroupLocks, do not invalidate
+// cached results, so they also expire after defaultQueryExpiration, or the
+// time given to WithQueryExpiration. Within a transaction the query is always
+// run against the datastore.
+func GetAll(c context.Context, q *datastore.Query, ancestor *datastore.Key,
+	name string, dst interface{}) ([]*datastore.Key, error) {
+
+	if ancestor == nil || ancestor.Incomplete() {
+		return nil, datastore.ErrInvalidKey
+	}
+
+	var dv reflect.Value
+	if dst != nil {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.IsNil() ||
+			dv.Elem().Kind() != reflect.Slice {
+			return nil, errors.New("nds: dst is not a pointer to a slice")
+		}
+	}
+
+	q = q.Ancestor(ancestor).KeysOnly()
+	keys, err := queryKeys(c, q, ancestor, name)
+	if err != nil || dst == nil {
+		return keys, err
+	}
+
+	vals := reflect.MakeSlice(dv.Elem().Type(), len(keys), len(keys))
+	err = GetMulti(c, keys, vals.Interface())
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	for _, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			deleteQueryKeys(c, ancestor, name)
+			break
+		}
+	}
+
+	dv.Elem().Set(reflect.AppendSlice(dv.Elem(), vals))
+	return keys, err
+}
+
+// deleteQueryKeys removes the keys cached for a query. Failures are only
+// logged as the cached keys still expire.
+func deleteQueryKeys(c context.Context, ancestor *datastore.Key, name string) {
+	memcacheCtx, err := memcacheContext(c)
+	if err == nil {
+		err = memcacheDeleteMulti(memcacheCtx,
+			[]string{createQueryMemcacheKey(ancestor, name)})
+	}
+	if me, ok := err.(appengine.MultiError); ok &&
+		me[0] == memcache.ErrCacheMiss {
+		return
+	}
+	if err != nil {
+		log.Warningf(c, "nds:deleteQueryKeys %s", err)
+	}
+}
+
+var withoutGroupLocksKey = "used for without group locks"
+
+// WithoutGroupLocks returns a context that stops PutMulti, Put, DeleteMulti
+// and Delete locking the entity groups of the keys they write, including
+// within RunInTransaction and WithInvalidationQueue. This saves a memcache
+// item per entity group on every write, but writes made with it do not
+// invalidate the results GetAll has cached for their groups. Those results
+// are then only refreshed once they expire, so it should only be used by apps
+// that never call GetAll, or for groups GetAll never queries.
+func WithoutGroupLocks(c context.Context) context.Context {
+	return context.WithValue(c, &withoutGroupLocksKey, true)
+}
+
+func groupLocksFromContext(c context.Context) bool {
+	withoutGroupLocks, _ := c.Value(&withoutGroupLocksKey).(bool)
+	return !withoutGroupLocks
+}
+
+// defaultQueryExpiration is how long GetAll caches query results for, unless
+// they are invalidated sooner or changed with WithQueryExpiration.
+const defaultQueryExpiration = 10 * time.Minute
+
+var queryExpirationKey = "used for query expiration"
+
+// WithQueryExpiration returns a context that makes GetAll expire its cached
+// query results after d rather than defaultQueryExpiration, in addition to
+// invalidating them on writes. A d of zero or less uses
+// defaultQueryExpiration; cached query results always expire as writes that
+// bypass nds cannot invalidate them.
+func WithQueryExpiration(c context.Context, d time.Duration) context.Context {
+	return context.WithValue(c, &queryExpirationKey, d)
+}
+
+func queryExpirationFromContext(c context.Context) time.Duration {
+	if d, ok := c.Value(&queryExpirationKey).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return defaultQueryExpiration
+}
+
+// defaultCountExpiration is how long Count caches a result for unless changed
+// with WithCountExpiration.
+const defaultCountExpiration = 10 * time.Second
+
+// Count returns the number of results for q, caching the count in memcache
+// under name so repeated calls within the expiration time do not run the
+// query. name must uniquely identify q amongst the counts the app caches in
+// the context's namespace; counts in other namespaces are cached separately.
+//
+// Unlike entities and GetAll results, cached counts are not invalidated by
+// writes and can be up to the expiration time stale. The expiration defaults
+// to defaultCountExpiration and can be changed with WithCountExpiration.
+// Within a transaction the count is always read from the datastore.
+func Count(c context.Context, q *datastore.Query, name string) (int, error) {
+	if _, ok := transactionFromContext(c); ok {
+		return queryCount(q, c)
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	countKey := createCountMemcacheKey(c, name)
+	items, err := memcacheGetMulti(memcacheCtx, []string{countKey})
+	if err != nil {
+		log.Warningf(c, "nds:Count GetMulti %s", err)
+	} else if item, ok := items[countKey]; ok &&
+		item.Flags == countItem && len(item.Value) == 8 {
+		return int(binary.LittleEndian.Uint64(item.Value)), nil
+	}
+
+	count, err := queryCount(q, c)
+	if err != nil {
+		return 0, err
+	}
+
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(count))
+	item := &memcache.Item{
+		Key:        countKey,
+		Flags:      countItem,
+		Value:      value,
+		Expiration: countExpirationFromContext(c),
+	}
+	if err := memcacheSetMulti(memcacheCtx,
+		[]*memcache.Item{item}); err != nil {
+		log.Warningf(c, "nds:Count SetMulti %s", err)
+	}
+	return count, nil
+}
+
+var countExpirationKey = "used for count expiration"
+
+// WithCountExpiration returns a context that makes Count cache its results
+// for d rather than defaultCountExpiration. A d of zero or less uses
+// defaultCountExpiration; counts always expire as writes do not invalidate
+// them.
+func WithCountExpiration(c context.Context, d time.Duration) context.Context {
+	return context.WithValue(c, &countExpirationKey, d)
+}
+
+func countExpirationFromContext(c context.Context) time.Duration {
+	if d, ok := c.Value(&countExpirationKey).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return defaultCountExpiration
+}
+
+// queryKeys returns the keys for q from memcache if they were cached with the
+// current token of ancestor's entity group, otherwise it runs q and caches the
+// result against that token.
+//
+// PutMulti and DeleteMulti replace the group token with a lock before writing
+// to the datastore and, in the case of PutMulti, remove it afterwards. A new
+// token is then created by the next queryKeys call, so results cached against
+// an old token, including any read while a write was in progress, are never
+// used again.
+func queryKeys(c context.Context, q *datastore.Query,
+	ancestor *datastore.Key, name string) ([]*datastore.Key, error) {
+
+	if _, ok := transactionFromContext(c); ok {
+		return queryGetAll(q, c, nil)
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	groupKey := createGroupMemcacheKey(ancestor)
+	queryKey := createQueryMemcacheKey(ancestor, name)
+
+	items, err := memcacheGetMulti(memcacheCtx, []string{groupKey, queryKey})
+	if err != nil {
+		log.Warningf(c, "nds:queryKeys GetMulti %s", err)
+		return queryGetAll(q, c, nil)
+	}
+
+	groupItem, ok := items[groupKey]
+	if !ok {
+		if groupItem, err = addGroupToken(memcacheCtx, groupKey); err != nil {
+			log.Warningf(c, "nds:queryKeys addGroupToken %s", err)
+			return queryGetAll(q, c, nil)
+		}
+	} else if queryItem, ok := items[queryKey]; ok &&
+		groupItem.Flags == groupTokenItem &&
+		queryItem.Flags == queryKeysItem &&
+		bytes.HasPrefix(queryItem.Value, groupItem.Value) {
+
+		keys := []*datastore.Key{}
+		value := queryItem.Value[len(groupItem.Value):]
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&keys)
+		if err == nil {
+			return keys, nil
+		}
+		log.Warningf(c, "nds:queryKeys decode %s", err)
+	}
+
+	keys, err := queryGetAll(q, c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The group is being written to so don't cache the result.
+	if groupItem.Flags != groupTokenItem {
+		return keys, nil
+	}
+
+	buf := bytes.NewBuffer(append([]byte{}, groupItem.Value...))
+	if err := gob.NewEncoder(buf).Encode(keys); err != nil {
+		log.Warningf(c, "nds:queryKeys encode %s", err)
+		return keys, nil
+	}
+
+	item := &memcache.Item{
+		Key:        queryKey,
+		Flags:      queryKeysItem,
+		Value:      buf.Bytes(),
+		Expiration: queryExpirationFromContext(c),
+	}
+	if err := memcacheSetMulti(memcacheCtx,
+		[]*memcache.Item{item}); err != nil {
+		log.Warningf(c, "nds:queryKeys SetMulti %s", err)
+	}
+	return keys, nil
+}
+
+// addGroupToken adds a new token for an entity group that has none and returns
+// whatever memcache then holds for the group. This is not necessarily the new
+// token as another call may have added its own or locked the group first.
+func addGroupToken(c context.Context, groupKey string) (*memcache.Item, error) {
+	item := &memcache.Item{
+		Key:   groupKey,
+		Flags: groupTokenItem,
+		Value: append(itemLock(), itemLock()...),
+	}
+	if err := memcacheAddMulti(c, []*memcache.Item{item}); err != nil {
+		if me, ok := err.(appengine.MultiError); !ok ||
+			me[0] != memcache.ErrNotStored {
+			return nil, err
+		}
+	}
+
+	items, err := memcacheGetMulti(c, []string{groupKey})
+	if err != nil {
+		return nil, err
+	}
+	if item, ok := items[groupKey]; ok {
+		return item, nil
+	}
+	return nil, errors.New("nds: group token missing")
+}
+
+// groupLockItems creates memcache locks for the entity groups of keys, which
+// invalidate the queries GetAll has cached for those groups. It returns no
+// locks if c was returned by WithoutGroupLocks. Keys that are nil or have an
+// incomplete root are skipped; the latter create new entity groups that
+// cannot have cached queries.
+func groupLockItems(c context.Context,
+	keys []*datastore.Key) []*memcache.Item {
+
+	if !groupLocksFromContext(c) {
+		return nil
+	}
+
+	lockTime := lockTimeFromContext(c)
+	items := []*memcache.Item{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		for key.Parent() != nil {
+			key = key.Parent()
+		}
+		if key.Incomplete() {
+			continue
+		}
+
+		groupKey := createGroupMemcacheKey(key)
+		if seen[groupKey] {
+			continue
+		}
+		seen[groupKey] = true
+
+		items = append(items, &memcache.Item{
+			Key:        groupKey,
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: lockTime,
+		})
+	}
+	return items
+}
+
+func createGroupMemcacheKey(key *datastore.Key) string {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	return shortenMemcacheKey(memcacheGroupPrefix + key.Encode())
+}
+
+func createQueryMemcacheKey(ancestor *datastore.Key, name string) string {
+	return shortenMemcacheKey(memcacheQueryPrefix +
+		ancestor.Encode() + ":" + name)
+}
+
+// createCountMemcacheKey includes the namespace q runs in, which is the
+// context's, so tenants with identically named counts are kept apart.
+// Namespaces never contain a colon.
+func createCountMemcacheKey(c context.Context, name string) string {
+	namespace := datastore.NewKey(c, "Count", name, 0, nil).Namespace()
+	return shortenMemcacheKey(memcacheCountPrefix + namespace + ":" + name)
+}
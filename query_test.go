@@ -0,0 +1,352 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetAll(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parentKey := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parentKey),
+		datastore.NewKey(c, "Entity", "", 2, parentKey),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	queryCount := 0
+	nds.SetQueryGetAll(func(q *datastore.Query,
+		c context.Context, dst interface{}) ([]*datastore.Key, error) {
+		queryCount++
+		return q.GetAll(c, dst)
+	})
+	defer nds.SetQueryGetAll((*datastore.Query).GetAll)
+
+	q := datastore.NewQuery("Entity").Order("IntVal")
+	for i := 0; i < 2; i++ {
+		entities := []testEntity{}
+		getKeys, err := nds.GetAll(c, q, parentKey, "byIntVal", &entities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(getKeys) != 2 || len(entities) != 2 {
+			t.Fatal("incorrect result length", len(getKeys), len(entities))
+		}
+		for j := range keys {
+			if !getKeys[j].Equal(keys[j]) {
+				t.Fatal("incorrect key", getKeys[j])
+			}
+			if entities[j].IntVal != int64(j+1) {
+				t.Fatal("incorrect IntVal", entities[j].IntVal)
+			}
+		}
+	}
+	if queryCount != 1 {
+		t.Fatal("expected query to run once but ran", queryCount)
+	}
+
+	// A new entity in the group invalidates the cached query.
+	newKey := datastore.NewIncompleteKey(c, "Entity", parentKey)
+	if _, err := nds.Put(c, newKey, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	getKeys, err := nds.GetAll(c, q, parentKey, "byIntVal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getKeys) != 3 {
+		t.Fatal("expected 3 keys but got", len(getKeys))
+	}
+
+	// As does a delete.
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	getKeys, err = nds.GetAll(c, q, parentKey, "byIntVal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getKeys) != 2 {
+		t.Fatal("expected 2 keys but got", len(getKeys))
+	}
+	if queryCount != 3 {
+		t.Fatal("expected query to run 3 times but ran", queryCount)
+	}
+}
+
+func TestGetAllStaleKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parentKey := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parentKey),
+		datastore.NewKey(c, "Entity", "", 2, parentKey),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Entity").Order("IntVal")
+	if _, err := nds.GetAll(c, q, parentKey, "byIntVal", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting without nds leaves the cached keys stale.
+	if err := datastore.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := []testEntity{}
+	getKeys, err := nds.GetAll(c, q, parentKey, "byIntVal", &entities)
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != datastore.ErrNoSuchEntity || me[1] != nil {
+		t.Fatal("expected ErrNoSuchEntity but got", err)
+	}
+	if len(getKeys) != 2 || len(entities) != 2 || entities[1].IntVal != 2 {
+		t.Fatal("expected partial results", getKeys, entities)
+	}
+
+	// The stale result is dropped so the query runs again.
+	entities = []testEntity{}
+	getKeys, err = nds.GetAll(c, q, parentKey, "byIntVal", &entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getKeys) != 1 || !getKeys[0].Equal(keys[1]) {
+		t.Fatal("incorrect keys", getKeys)
+	}
+}
+
+func TestGetAllExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	var expiration time.Duration
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Flags == nds.QueryKeysItem {
+				expiration = item.Expiration
+			}
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	q := datastore.NewQuery("Entity")
+	for i, expected := range []struct {
+		c          context.Context
+		expiration time.Duration
+	}{
+		{c, 10 * time.Minute},
+		{nds.WithQueryExpiration(c, 0), 10 * time.Minute},
+		{nds.WithQueryExpiration(c, time.Hour), time.Hour},
+	} {
+		// A new ancestor each time so the query is not already cached.
+		ancestor := datastore.NewKey(c, "Parent", "", int64(i+1), nil)
+		expiration = 0
+		if _, err := nds.GetAll(expected.c, q, ancestor,
+			"all", nil); err != nil {
+			t.Fatal(err)
+		}
+		if expiration != expected.expiration {
+			t.Fatal("expected expiration", expected.expiration,
+				"but got", expiration)
+		}
+	}
+}
+
+// Writes lock entity groups unless asked not to.
+func TestGroupLocksOptOut(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	lockCount := 0
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		lockCount += len(items)
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	parentKey := datastore.NewKey(c, "Parent", "", 1, nil)
+	key := datastore.NewKey(c, "Entity", "", 1, parentKey)
+	for _, expected := range []struct {
+		c         context.Context
+		lockCount int
+	}{{c, 2}, {nds.WithoutGroupLocks(c), 1}} {
+		lockCount = 0
+		if err := nds.Delete(expected.c, key); err != nil {
+			t.Fatal(err)
+		}
+		if lockCount != expected.lockCount {
+			t.Fatal("expected", expected.lockCount, "locks but got", lockCount)
+		}
+	}
+}
+
+func TestGetAllInvalidAncestor(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	q := datastore.NewQuery("Entity")
+	if _, err := nds.GetAll(c, q, nil, "all", nil); err != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key error but got", err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parentKey := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parentKey),
+		datastore.NewKey(c, "Entity", "", 2, parentKey),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	countCalls := 0
+	nds.SetQueryCount(func(q *datastore.Query,
+		c context.Context) (int, error) {
+		countCalls++
+		return q.Count(c)
+	})
+	defer nds.SetQueryCount((*datastore.Query).Count)
+
+	q := datastore.NewQuery("Entity").Ancestor(parentKey)
+	for i := 0; i < 2; i++ {
+		count, err := nds.Count(c, q, "entities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatal("incorrect count", count)
+		}
+	}
+	if countCalls != 1 {
+		t.Fatal("expected count to run once but ran", countCalls)
+	}
+
+	item, err := memcache.Get(c, nds.CreateCountMemcacheKey(c, "entities"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.CountItem {
+		t.Fatal("expected count item but got flags", item.Flags)
+	}
+
+	// Counts cached under other names are independent.
+	if _, err := nds.Count(c, q, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if countCalls != 2 {
+		t.Fatal("expected count to run twice but ran", countCalls)
+	}
+}
+
+func TestCountNamespaces(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	aCtx, err := appengine.Namespace(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bCtx, err := appengine.Namespace(c, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ancestor queries keep the counts strongly consistent.
+	aParent := datastore.NewKey(aCtx, "Parent", "", 1, nil)
+	bParent := datastore.NewKey(bCtx, "Parent", "", 1, nil)
+
+	aKeys := []*datastore.Key{
+		datastore.NewKey(aCtx, "Entity", "", 1, aParent),
+		datastore.NewKey(aCtx, "Entity", "", 2, aParent),
+	}
+	if _, err := nds.PutMulti(aCtx, aKeys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	bKey := datastore.NewKey(bCtx, "Entity", "", 1, bParent)
+	if _, err := nds.Put(bCtx, bKey, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []struct {
+		c      context.Context
+		parent *datastore.Key
+		count  int
+	}{
+		{aCtx, aParent, 2},
+		{bCtx, bParent, 1},
+		{aCtx, aParent, 2},
+		{bCtx, bParent, 1},
+	} {
+		q := datastore.NewQuery("Entity").Ancestor(expected.parent)
+		count, err := nds.Count(expected.c, q, "entities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected.count {
+			t.Fatal("expected count", expected.count, "but got", count)
+		}
+	}
+}
+
+func TestWithCountExpiration(t *testing.T) {
+	c := context.Background()
+	for _, test := range []struct {
+		d, expiration time.Duration
+	}{
+		{0, 10 * time.Second},
+		{-time.Second, 10 * time.Second},
+		{time.Minute, time.Minute},
+	} {
+		expiration := nds.CountExpirationFromContext(
+			nds.WithCountExpiration(c, test.d))
+		if expiration != test.expiration {
+			t.Fatal("expected expiration", test.expiration, "for", test.d,
+				"but got", expiration)
+		}
+	}
+}
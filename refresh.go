@@ -0,0 +1,182 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// Refresh loads the entity stored for key from the datastore into val,
+// ignoring anything held in memcache, and then replaces the memcache entry
+// with it. It is intended for operators repairing an entry known to be stale.
+//
+// The memcache entry is replaced using the same locking strategy as GetMulti,
+// so Refresh never caches an entity that is changed by a concurrent Put or
+// Delete. If memcache already holds a lock for the key, or the entry changes
+// during the call, memcache is left as it is and the entity is cached by a
+// later Get instead.
+//
+// Like Get, Refresh returns datastore.ErrNoSuchEntity if there is no entity
+// for key, in which case that is recorded in memcache. Refresh cannot be used
+// within a transaction.
+func Refresh(c context.Context, key *datastore.Key, val interface{}) error {
+	return refresh(c, key, val, false)
+}
+
+// ForceRefresh works like Refresh except it overwrites the memcache entry
+// unconditionally rather than using the GetMulti locking strategy. This saves
+// a memcache call but a Put or Delete of the entity that completes while
+// ForceRefresh is running can leave the older entity cached until the key is
+// next written.
+func ForceRefresh(c context.Context, key *datastore.Key, val interface{}) error {
+	return refresh(c, key, val, true)
+}
+
+func refresh(c context.Context,
+	key *datastore.Key, val interface{}, force bool) error {
+
+	if val == nil {
+		return datastore.ErrInvalidEntityType
+	}
+
+	if _, ok := transactionFromContext(c); ok {
+		return errors.New("nds: Refresh cannot be used in a transaction")
+	}
+
+	vals := reflect.ValueOf([]interface{}{val})
+	if err := checkKeysValues([]*datastore.Key{key}, vals); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			return me[0]
+		}
+		return err
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return err
+	}
+
+	cacheItems := []cacheItem{{
+		key:         key,
+		memcacheKey: createMemcacheKey(key),
+		val:         vals.Index(0),
+		state:       internalLock,
+		item: &memcache.Item{
+			Key:        createMemcacheKey(key),
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: lockTimeFromContext(c),
+		},
+	}}
+
+	if !force {
+		lockRefresh(memcacheCtx, cacheItems)
+	}
+
+	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+		return err
+	}
+
+	if force {
+		if cacheItems[0].state == internalLock {
+			if err := memcacheSetMulti(memcacheCtx,
+				[]*memcache.Item{cacheItems[0].item}); err != nil {
+				return err
+			}
+		}
+	} else {
+		saveMemcache(memcacheCtx, cacheItems)
+	}
+
+	return cacheItems[0].err
+}
+
+// lockRefresh locks memcache for the cache items and then gets the locks back
+// so loadDatastore and saveMemcache can fill them using CAS. Entries holding
+// an entity, or the lack of one, are replaced with a lock using CAS, and
+// missing entries are added. An existing lock is never replaced as it may be
+// the only thing stopping a concurrent Put, Delete or transaction commit from
+// having a stale entity cached over it. If memcache fails the cache items are
+// left to be read from the datastore without being cached.
+func lockRefresh(c context.Context, cacheItems []cacheItem) {
+
+	memcacheKeys := make([]string, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		memcacheKeys[i] = cacheItem.memcacheKey
+	}
+
+	items, err := memcacheGetMulti(c, memcacheKeys)
+	if err != nil {
+		for i := range cacheItems {
+			cacheItems[i].state = externalLock
+		}
+		log.Warningf(c, "nds:lockRefresh GetMulti %s", err)
+		return
+	}
+
+	addItems := make([]*memcache.Item, 0, len(cacheItems))
+	casItems := make([]*memcache.Item, 0, len(cacheItems))
+	lockMemcacheKeys := make([]string, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		item, ok := items[cacheItem.memcacheKey]
+		switch {
+		case !ok:
+			addItems = append(addItems, cacheItem.item)
+		case itemType(item.Flags) == lockItem:
+			// Another call holds the entity so leave memcache alone.
+			cacheItems[i].state = externalLock
+			continue
+		default:
+			// Swap the lock in against the item just read so that any write
+			// since then wins.
+			item.Flags = cacheItem.item.Flags
+			item.Value = cacheItem.item.Value
+			item.Expiration = cacheItem.item.Expiration
+			casItems = append(casItems, item)
+		}
+		lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
+	}
+
+	// We don't care if there are errors here as failed locks are detected
+	// when getting them back below.
+	if err := memcacheAddMulti(c, addItems); err != nil {
+		log.Warningf(c, "nds:lockRefresh AddMulti %s", err)
+	}
+	if err := memcacheCompareAndSwapMulti(c, casItems); err != nil {
+		log.Warningf(c, "nds:lockRefresh CompareAndSwapMulti %s", err)
+	}
+
+	if len(lockMemcacheKeys) == 0 {
+		return
+	}
+
+	items, err = memcacheGetMulti(c, lockMemcacheKeys)
+	if err != nil {
+		for i := range cacheItems {
+			cacheItems[i].state = externalLock
+		}
+		log.Warningf(c, "nds:lockRefresh GetMulti %s", err)
+		return
+	}
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == externalLock {
+			continue
+		}
+		item, ok := items[cacheItem.memcacheKey]
+		if ok && item.Flags == lockItem &&
+			bytes.Equal(item.Value, cacheItem.item.Value) {
+			cacheItems[i].item = item
+		} else {
+			// Another call has locked or written the entity since we read it
+			// so leave memcache alone.
+			cacheItems[i].state = externalLock
+		}
+	}
+}
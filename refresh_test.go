@@ -0,0 +1,155 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestRefresh(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	refreshFuncs := []func(context.Context, *datastore.Key, interface{}) error{
+		nds.Refresh,
+		nds.ForceRefresh,
+	}
+
+	for i, refresh := range refreshFuncs {
+		key := datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Prime cache then make it stale by bypassing nds.
+		if err := nds.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+			t.Fatal(err)
+		}
+
+		entity := &testEntity{}
+		if err := refresh(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 2 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+
+		// Make sure the refreshed entity now comes from memcache.
+		nds.SetDatastoreGetMulti(func(c context.Context,
+			keys []*datastore.Key, vals interface{}) error {
+			if len(keys) == 0 {
+				return nil
+			}
+			return errors.New("expected memcache hit")
+		})
+
+		entity = &testEntity{}
+		err := nds.Get(c, key, entity)
+		nds.SetDatastoreGetMulti(datastore.GetMulti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 2 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+}
+
+func TestRefreshNoSuchEntity(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := nds.Refresh(c, key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity error but got", err)
+	}
+}
+
+// Refresh must not replace a lock set by another call, such as a Delete, as
+// that lock is all that stops a stale entity being cached.
+func TestRefreshForeignLock(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	lock := &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte("foreign lock"),
+	}
+	if err := memcache.Set(c, lock); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Refresh(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem || string(item.Value) != "foreign lock" {
+		t.Fatal("foreign lock was replaced", item.Flags, string(item.Value))
+	}
+}
+
+// The datastore is authoritative so Refresh still loads the entity when
+// memcache fails.
+func TestRefreshMemcacheFail(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, errors.New("expected error")
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	entity := &testEntity{}
+	if err := nds.Refresh(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
@@ -0,0 +1,70 @@
+package nds
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// CacheStats counts how GetMulti served the keys it was called with.
+type CacheStats struct {
+	// Hits is the number of keys served from memcache, including keys
+	// memcache recorded as having no entity.
+	Hits int64
+
+	// Misses is the number of keys read from the datastore.
+	Misses int64
+
+	// LockContention is the number of Misses that could not be saved to
+	// memcache because another call held the memcache lock for the key.
+	LockContention int64
+}
+
+var cacheStatsKey = "used for *cacheStats"
+
+type cacheStats struct {
+	hits           int64
+	misses         int64
+	lockContention int64
+}
+
+// WithStats returns a context that counts the cache hits and misses of every
+// GetMulti and Get made with it, or any context derived from it, until the
+// counts are read with Stats. Calling WithStats again starts a new set of
+// counts, so a request can reset them by deriving a fresh context from its
+// original one.
+func WithStats(c context.Context) context.Context {
+	return context.WithValue(c, &cacheStatsKey, &cacheStats{})
+}
+
+// Stats returns a snapshot of the counts for a context created with WithStats.
+// The counts are zero if c was not created with WithStats.
+func Stats(c context.Context) CacheStats {
+	s := cacheStatsFromContext(c)
+	if s == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:           atomic.LoadInt64(&s.hits),
+		Misses:         atomic.LoadInt64(&s.misses),
+		LockContention: atomic.LoadInt64(&s.lockContention),
+	}
+}
+
+// cacheStatsFromContext returns the context's cacheStats, or nil if it has
+// none.
+func cacheStatsFromContext(c context.Context) *cacheStats {
+	s, _ := c.Value(&cacheStatsKey).(*cacheStats)
+	return s
+}
+
+// add adds to the counts. It is safe to call on a nil cacheStats and
+// concurrently, as GetMulti loads its batches in parallel.
+func (s *cacheStats) add(hits, misses, lockContention int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.hits, hits)
+	atomic.AddInt64(&s.misses, misses)
+	atomic.AddInt64(&s.lockContention, lockContention)
+}
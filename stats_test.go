@@ -0,0 +1,72 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestStats(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := nds.Stats(c); stats != (nds.CacheStats{}) {
+		t.Fatal("expected no stats", stats)
+	}
+
+	sc := nds.WithStats(c)
+	getMulti := func() {
+		vals := make([]testEntity, len(keys))
+		err := nds.GetMulti(sc, keys, vals)
+		if me, ok := err.(appengine.MultiError); !ok ||
+			me[2] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected ErrNoSuchEntity", err)
+		}
+	}
+
+	getMulti()
+	if stats := nds.Stats(sc); stats != (nds.CacheStats{
+		Misses: 3}) {
+		t.Fatal("incorrect stats", stats)
+	}
+
+	// The missing entity is cached too.
+	getMulti()
+	if stats := nds.Stats(sc); stats != (nds.CacheStats{
+		Hits: 3, Misses: 3}) {
+		t.Fatal("incorrect stats", stats)
+	}
+
+	// Another call's lock leaves the entity to be read from the datastore.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[0]),
+		Flags: nds.LockItem,
+		Value: []byte("lock"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sc = nds.WithStats(c)
+	getMulti()
+	if stats := nds.Stats(sc); stats != (nds.CacheStats{
+		Hits: 2, Misses: 1, LockContention: 1}) {
+		t.Fatal("incorrect stats", stats)
+	}
+}
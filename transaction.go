@@ -23,6 +23,12 @@ func transactionFromContext(c context.Context) (*transaction, bool) {
 // RunInTransaction works just like datastore.RunInTransaction however it
 // interacts correctly with memcache. You should always use this method for
 // transactions if you are using the NDS package.
+//
+// opts is passed straight to datastore.RunInTransaction, so cross-group
+// transactions are enabled with &datastore.TransactionOptions{XG: true}.
+// Memcache locks are collected for every key put or deleted within the
+// transaction, whichever entity group it belongs to, and set before the
+// transaction commits.
 func RunInTransaction(c context.Context, f func(tc context.Context) error,
 	opts *datastore.TransactionOptions) error {
 
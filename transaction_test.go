@@ -99,3 +99,54 @@ func TestClearNamespacedLocks(t *testing.T) {
 		t.Fatal("incorrect val")
 	}
 }
+
+// TestTransactionXGCache makes sure memcache is invalidated for every entity
+// group written in a cross-group transaction.
+func TestTransactionXGCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {1}, {1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &datastore.TransactionOptions{XG: true}
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, keys[0], &testEntity{2}); err != nil {
+			return err
+		}
+		if _, err := nds.Put(tc, keys[1], &testEntity{2}); err != nil {
+			return err
+		}
+		return nds.Delete(tc, keys[2])
+	}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(c, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity error but got", err)
+	}
+	for i := 0; i < 2; i++ {
+		if entities[i].Val != 2 {
+			t.Fatal("incorrect Val", entities[i].Val)
+		}
+	}
+}
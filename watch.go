@@ -0,0 +1,93 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// KeyEventType is the type of a KeyEvent.
+type KeyEventType int
+
+const (
+	// KeyCacheHit means GetMulti found the entity, or the lack of one, in
+	// memcache.
+	KeyCacheHit KeyEventType = iota
+
+	// KeyCacheMiss means GetMulti found nothing in memcache for the key.
+	KeyCacheMiss
+
+	// KeyCacheLocked means GetMulti found another call's lock in memcache so
+	// read the entity from the datastore without caching it.
+	KeyCacheLocked
+
+	// KeyLock means GetMulti locked memcache so it can cache the entity it
+	// reads from the datastore.
+	KeyLock
+
+	// KeyCacheFill means GetMulti saved the entity it read from the datastore
+	// to memcache.
+	KeyCacheFill
+
+	// KeyCASConflict means GetMulti could not save the entity to memcache as
+	// its lock had been replaced.
+	KeyCASConflict
+
+	// KeyPut means PutMulti is locking memcache to put the entity.
+	KeyPut
+
+	// KeyDelete means DeleteMulti is locking memcache to delete the entity.
+	KeyDelete
+
+	// KeyLockOutstanding means DeleteMulti failed to delete the entity from
+	// the datastore and left its memcache lock to expire, so the entity will
+	// not be cached until then. See WithDeleteLockCleanup.
+	KeyLockOutstanding
+)
+
+// KeyEvent describes an operation nds performed on a watched key.
+type KeyEvent struct {
+	Key  *datastore.Key
+	Type KeyEventType
+}
+
+var keyWatchKey = "used for *keyWatch"
+
+type keyWatch struct {
+	memcacheKeys map[string]bool
+	f            func(KeyEvent)
+}
+
+// WithKeyWatch returns a context that calls f for every operation nds performs
+// on any of keys, while leaving all other keys untraced. It is intended for
+// debugging the caching of specific problematic entities. Nil keys are
+// ignored. f can be called concurrently by GetMulti, PutMulti and DeleteMulti.
+func WithKeyWatch(c context.Context,
+	keys []*datastore.Key, f func(KeyEvent)) context.Context {
+
+	w := &keyWatch{
+		memcacheKeys: make(map[string]bool, len(keys)),
+		f:            f,
+	}
+	for _, key := range keys {
+		if key != nil {
+			w.memcacheKeys[createMemcacheKey(key)] = true
+		}
+	}
+	return context.WithValue(c, &keyWatchKey, w)
+}
+
+// keyWatchFromContext returns the context's keyWatch, or nil if it has none.
+func keyWatchFromContext(c context.Context) *keyWatch {
+	w, _ := c.Value(&keyWatchKey).(*keyWatch)
+	return w
+}
+
+// emit calls the watch function if memcacheKey is watched. It is safe to call
+// on a nil keyWatch.
+func (w *keyWatch) emit(key *datastore.Key,
+	memcacheKey string, eventType KeyEventType) {
+
+	if w != nil && w.memcacheKeys[memcacheKey] {
+		w.f(KeyEvent{Key: key, Type: eventType})
+	}
+}
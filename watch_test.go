@@ -0,0 +1,124 @@
+package nds_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestKeyWatch(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	watchedKey := datastore.NewKey(c, "Entity", "", 1, nil)
+	otherKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	keys := []*datastore.Key{watchedKey, otherKey}
+
+	var mu sync.Mutex
+	events := []nds.KeyEvent{}
+	wc := nds.WithKeyWatch(c, []*datastore.Key{watchedKey},
+		func(event nds.KeyEvent) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		})
+
+	if _, err := nds.PutMulti(wc, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.GetMulti(wc, keys,
+			make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nds.DeleteMulti(wc, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTypes := []nds.KeyEventType{
+		nds.KeyPut,
+		nds.KeyCacheMiss,
+		nds.KeyLock,
+		nds.KeyCacheFill,
+		nds.KeyCacheHit,
+		nds.KeyDelete,
+	}
+	if len(events) != len(expectedTypes) {
+		t.Fatal("incorrect number of events", events)
+	}
+	for i, event := range events {
+		if !event.Key.Equal(watchedKey) {
+			t.Fatal("event for unwatched key", event.Key)
+		}
+		if event.Type != expectedTypes[i] {
+			t.Fatal("incorrect event type", i, event.Type, expectedTypes[i])
+		}
+	}
+}
+
+func TestKeyWatchNilKey(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	nds.WithKeyWatch(c, []*datastore.Key{nil, key}, func(nds.KeyEvent) {})
+}
+
+// An entity cached by another call between loadMemcache and lockMemcache is
+// still reported as a hit.
+func TestKeyWatchLockHit(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	filled := false
+	nds.SetMemcacheAddMulti(func(mc context.Context,
+		items []*memcache.Item) error {
+		if !filled {
+			filled = true
+			if err := nds.Get(c, key, &testEntity{}); err != nil {
+				return err
+			}
+		}
+		return memcache.AddMulti(mc, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	events := []nds.KeyEventType{}
+	wc := nds.WithKeyWatch(c, []*datastore.Key{key}, func(e nds.KeyEvent) {
+		events = append(events, e.Type)
+	})
+
+	entity := &testEntity{}
+	if err := nds.Get(wc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	expected := []nds.KeyEventType{nds.KeyCacheMiss, nds.KeyCacheHit}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatal("expected events", expected, "but got", events)
+	}
+}